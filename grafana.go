@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+const (
+	// grafanaScope is the Entra ID scope for Azure Managed Grafana.
+	grafanaScope = "ce34e7e5-485f-4d76-964f-b3d2b16d1e4f/.default"
+
+	// annotationQueueSize bounds the events buffered before start; anything
+	// beyond it is dropped rather than blocking the probe.
+	annotationQueueSize = 16
+
+	// defaultFailureSampleRate annotates every failure: with a single
+	// designated poster there is no fleet of pods to thin out.
+	defaultFailureSampleRate = 1.0
+)
+
+// grafanaAnnotator posts run events to the Grafana annotations API so they
+// show up on the dashboard graphs. Events are queued with their timestamp
+// and only posted once start is called, which main does after the Cosmos
+// operation so that Grafana calls (and the IMDS token request they need with
+// MSI auth) never run ahead of, or delay, the probe being measured.
+//
+// A nil *grafanaAnnotator is valid and drops every event, which keeps call
+// sites free of enabled checks.
+type grafanaAnnotator struct {
+	url               string
+	token             string
+	cred              azcore.TokenCredential
+	tags              []string
+	failureSampleRate float64
+	client            *http.Client
+
+	queue chan grafanaAnnotation
+	done  chan struct{}
+}
+
+// newGrafanaAnnotator builds an annotator from the environment. Annotations
+// are opt-in: it returns nil unless ANNOTATE_EVENTS=true, which should only
+// be set on a single designated poster rather than across the DaemonSet.
+// GRAFANA_URL is then required. GRAFANA_TOKEN selects service account token
+// auth; otherwise GRAFANA_USE_MSI=true authenticates with the pod's managed
+// identity. ANNOTATE_FAILURE_SAMPLE_RATE (default 1) is the fraction of
+// operation failures that are annotated.
+func newGrafanaAnnotator() (*grafanaAnnotator, error) {
+	if enabled, _ := strconv.ParseBool(os.Getenv("ANNOTATE_EVENTS")); !enabled {
+		return nil, nil
+	}
+
+	grafanaURL := strings.TrimSuffix(os.Getenv("GRAFANA_URL"), "/")
+	if grafanaURL == "" {
+		return nil, fmt.Errorf("GRAFANA_URL environment variable is required when ANNOTATE_EVENTS is set")
+	}
+
+	a := &grafanaAnnotator{
+		url:               grafanaURL + "/api/annotations",
+		token:             os.Getenv("GRAFANA_TOKEN"),
+		tags:              []string{"cosmos-msi-scale-test"},
+		failureSampleRate: defaultFailureSampleRate,
+		client:            &http.Client{Timeout: 10 * time.Second},
+		queue:             make(chan grafanaAnnotation, annotationQueueSize),
+		done:              make(chan struct{}),
+	}
+	if runID := os.Getenv("RUN_ID"); runID != "" {
+		a.tags = append(a.tags, "run:"+runID)
+	}
+	if v := os.Getenv("ANNOTATE_FAILURE_SAMPLE_RATE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid ANNOTATE_FAILURE_SAMPLE_RATE %q", v)
+		}
+		a.failureSampleRate = rate
+	}
+
+	if useMSI, _ := strconv.ParseBool(os.Getenv("GRAFANA_USE_MSI")); useMSI && a.token == "" {
+		var opts *azidentity.ManagedIdentityCredentialOptions
+		if clientID := os.Getenv("AZURE_CLIENT_ID"); clientID != "" {
+			opts = &azidentity.ManagedIdentityCredentialOptions{ID: azidentity.ClientID(clientID)}
+		}
+		cred, err := azidentity.NewManagedIdentityCredential(opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create managed identity credential for Grafana: %w", err)
+		}
+		a.cred = cred
+	}
+	if a.token == "" && a.cred == nil {
+		log.Println("Neither GRAFANA_TOKEN nor GRAFANA_USE_MSI is set; Grafana annotations will be posted without authentication")
+	}
+	return a, nil
+}
+
+type grafanaAnnotation struct {
+	Time int64    `json:"time"`
+	Tags []string `json:"tags"`
+	Text string   `json:"text"`
+}
+
+// annotate queues an event stamped with the current time. It never blocks;
+// events are dropped if the queue is full.
+func (a *grafanaAnnotator) annotate(event, text string) {
+	if a == nil {
+		return
+	}
+	ann := grafanaAnnotation{
+		Time: time.Now().UnixMilli(),
+		Tags: append([]string{"event:" + event}, a.tags...),
+		Text: text,
+	}
+	select {
+	case a.queue <- ann:
+	default:
+		log.Printf("Grafana annotation queue full, dropping %q", event)
+	}
+}
+
+// annotateFailure queues a failure event, subject to the failure sample rate
+// for runs that still post from more than one pod.
+func (a *grafanaAnnotator) annotateFailure(text string) {
+	if a == nil || rand.Float64() >= a.failureSampleRate {
+		return
+	}
+	a.annotate("operation-failed", text)
+}
+
+// start posts queued and future events in the background. Failures are
+// logged and otherwise ignored; annotations must never affect the test.
+func (a *grafanaAnnotator) start() {
+	if a == nil {
+		return
+	}
+	go func() {
+		defer close(a.done)
+		for ann := range a.queue {
+			if err := a.post(context.Background(), ann); err != nil {
+				log.Printf("Failed to post Grafana annotation %v: %v", ann.Tags, err)
+			}
+		}
+	}()
+}
+
+// stop waits up to timeout for queued events to be posted. No events may be
+// added after stop.
+func (a *grafanaAnnotator) stop(timeout time.Duration) {
+	if a == nil {
+		return
+	}
+	close(a.queue)
+	select {
+	case <-a.done:
+	case <-time.After(timeout):
+		log.Println("Timed out posting Grafana annotations")
+	}
+}
+
+func (a *grafanaAnnotator) post(ctx context.Context, ann grafanaAnnotation) error {
+	body, err := json.Marshal(ann)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	switch {
+	case a.token != "":
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	case a.cred != nil:
+		tk, err := a.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{grafanaScope}})
+		if err != nil {
+			return fmt.Errorf("failed to get Grafana token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tk.Token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestGrafanaAnnotatorPostsEvents(t *testing.T) {
+	var got []grafanaAnnotation
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/annotations" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer sa-token" {
+			t.Errorf("Authorization = %q, want %q", auth, "Bearer sa-token")
+		}
+		var ann grafanaAnnotation
+		if err := json.NewDecoder(r.Body).Decode(&ann); err != nil {
+			t.Errorf("failed to decode annotation: %v", err)
+		}
+		got = append(got, ann)
+		w.Write([]byte(`{"id":1}`))
+	}))
+	defer srv.Close()
+
+	t.Setenv("ANNOTATE_EVENTS", "true")
+	t.Setenv("GRAFANA_URL", srv.URL+"/")
+	t.Setenv("GRAFANA_TOKEN", "sa-token")
+	t.Setenv("RUN_ID", "run-1")
+
+	a, err := newGrafanaAnnotator()
+	if err != nil {
+		t.Fatalf("newGrafanaAnnotator: %v", err)
+	}
+	a.annotate("run-start", "started")
+	a.start()
+	a.annotate("run-stop", "stopped")
+	a.stop(5 * time.Second)
+
+	if len(got) != 2 {
+		t.Fatalf("got %d annotations, want 2", len(got))
+	}
+	for i, event := range []string{"event:run-start", "event:run-stop"} {
+		if !slices.Contains(got[i].Tags, event) || !slices.Contains(got[i].Tags, "run:run-1") {
+			t.Errorf("annotation %d tags = %v, want %q and %q", i, got[i].Tags, event, "run:run-1")
+		}
+		if got[i].Time == 0 {
+			t.Errorf("annotation %d has no time", i)
+		}
+	}
+}
+
+func TestGrafanaAnnotatorPostReturnsErrorOnFailureStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	a := &grafanaAnnotator{url: srv.URL + "/api/annotations", client: srv.Client()}
+	if err := a.post(context.Background(), grafanaAnnotation{Text: "x"}); err == nil {
+		t.Fatal("expected an error for HTTP 401")
+	}
+}
+
+func TestGrafanaAnnotatorRequiresOptIn(t *testing.T) {
+	t.Setenv("ANNOTATE_EVENTS", "")
+	t.Setenv("GRAFANA_URL", "http://127.0.0.1:1")
+
+	a, err := newGrafanaAnnotator()
+	if err != nil || a != nil {
+		t.Fatalf("newGrafanaAnnotator() = %v, %v; want nil, nil", a, err)
+	}
+	// A nil annotator drops events without panicking
+	a.annotate("run-start", "started")
+	a.annotateFailure("failed")
+	a.start()
+	a.stop(time.Second)
+}
+
+func TestGrafanaAnnotatorRejectsInvalidConfig(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		"missing url":       {"GRAFANA_URL": ""},
+		"invalid rate":      {"GRAFANA_URL": "http://127.0.0.1:1", "ANNOTATE_FAILURE_SAMPLE_RATE": "abc"},
+		"rate out of range": {"GRAFANA_URL": "http://127.0.0.1:1", "ANNOTATE_FAILURE_SAMPLE_RATE": "1.5"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("ANNOTATE_EVENTS", "true")
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			if _, err := newGrafanaAnnotator(); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -7,12 +7,15 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
-	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -36,7 +39,11 @@ var (
 		Name: "cosmos_other_error_total",
 		Help: "Total number of other errors when connecting to Cosmos DB",
 	})
-	
+	operationDuration = prometheus.NewHistogramVec(latencyHistogramOpts(
+		"cosmos_operation_duration_seconds",
+		"Latency of Cosmos DB table operations, including token acquisition",
+	), []string{"client", "operation", "result"})
+
 	healthStatus int32 = healthyStatus
 )
 
@@ -44,6 +51,26 @@ func init() {
 	prometheus.MustRegister(successCounter)
 	prometheus.MustRegister(authErrorCounter)
 	prometheus.MustRegister(otherErrorCounter)
+	prometheus.MustRegister(operationDuration)
+}
+
+// latencyHistogramOpts returns options for a native (sparse) histogram, which
+// keeps good resolution from sub-millisecond IMDS calls up to multi-second
+// Cosmos retries without a large number of series. Setting
+// CLASSIC_HISTOGRAM_BUCKETS=true also exposes classic buckets for scrapers
+// that don't support native histograms.
+func latencyHistogramOpts(name, help string) prometheus.HistogramOpts {
+	opts := prometheus.HistogramOpts{
+		Name:                            name,
+		Help:                            help,
+		NativeHistogramBucketFactor:     1.1,
+		NativeHistogramMaxBucketNumber:  160,
+		NativeHistogramMinResetDuration: time.Hour,
+	}
+	if classic, _ := strconv.ParseBool(os.Getenv("CLASSIC_HISTOGRAM_BUCKETS")); classic {
+		opts.Buckets = prometheus.ExponentialBuckets(0.001, 2, 16)
+	}
+	return opts
 }
 
 func main() {
@@ -63,6 +90,13 @@ func main() {
 		metricsPort = "8080"
 	}
 
+	// Annotations are opt-in, so a bad configuration for them is fatal rather
+	// than silently disabling them
+	annotator, err := newGrafanaAnnotator()
+	if err != nil {
+		log.Fatalf("Invalid Grafana annotation configuration: %v", err)
+	}
+
 	log.Printf("Starting Cosmos MSI Scale Test Application")
 	log.Printf("Cosmos Account URL: %s", cosmosAccountURL)
 	log.Printf("Table Name: %s", tableName)
@@ -80,22 +114,80 @@ func main() {
 		}
 	}()
 
+	nodeName := os.Getenv("NODE_NAME")
+	annotator.annotate("run-start", fmt.Sprintf("Probe started on node %s", nodeName))
+
 	// Perform Cosmos DB connection and table operation
 	if err := performCosmosOperation(cosmosAccountURL, tableName); err != nil {
 		log.Printf("Error performing Cosmos operation: %v", err)
 		atomic.StoreInt32(&healthStatus, unhealthyStatus)
+		annotator.annotateFailure(fmt.Sprintf("Cosmos operation failed on node %s: %v", nodeName, err))
 	} else {
 		log.Printf("Successfully performed Cosmos operation")
 	}
 
+	// Only talk to Grafana once the measured operation is done
+	annotator.start()
+
 	// Keep the application running to serve metrics
 	log.Println("Application running. Press Ctrl+C to exit.")
-	select {}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	log.Printf("Received %s, shutting down", sig)
+	annotator.annotate("run-stop", fmt.Sprintf("Probe stopped on node %s", nodeName))
+	annotator.stop(5 * time.Second)
 }
 
 func performCosmosOperation(accountURL, tableName string) error {
 	ctx := context.Background()
 
+	cred, err := newCredential()
+	if err != nil {
+		otherErrorCounter.Inc()
+		return err
+	}
+
+	// Create a table client for Cosmos DB
+	client, err := newTableClient(accountURL, tableName, cred)
+	if err != nil {
+		log.Printf("Failed to create service client: %v", err)
+		otherErrorCounter.Inc()
+		return fmt.Errorf("failed to create service client: %w", err)
+	}
+
+	if err := createTable(ctx, client, tableName); err != nil {
+		return err
+	}
+
+	if enabled, _ := strconv.ParseBool(os.Getenv("METADATA_FORMAT_COMPARISON")); enabled {
+		if err := runMetadataFormatComparison(ctx, client); err != nil {
+			// The comparison is an optional workload; don't mark the pod unhealthy
+			log.Printf("Metadata format comparison failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// newCredential creates the credential selected by CREDENTIAL_MODE: "msi"
+// (the default) uses the node's managed identity through IMDS, and
+// "tokenrequest" federates a service account token obtained from the
+// Kubernetes TokenRequest API.
+func newCredential() (azcore.TokenCredential, error) {
+	switch mode := os.Getenv("CREDENTIAL_MODE"); mode {
+	case "", "msi":
+	case "tokenrequest":
+		log.Println("Creating TokenRequest federated credential...")
+		cred, err := newTokenRequestCredential()
+		if err != nil {
+			log.Printf("Failed to create TokenRequest credential: %v", err)
+			return nil, fmt.Errorf("failed to create tokenrequest credential: %w", err)
+		}
+		return cred, nil
+	default:
+		return nil, fmt.Errorf("unknown CREDENTIAL_MODE %q", mode)
+	}
+
 	// Get the client ID from environment variable
 	clientID := os.Getenv("AZURE_CLIENT_ID")
 	
@@ -116,22 +208,17 @@ func performCosmosOperation(accountURL, tableName string) error {
 	
 	if err != nil {
 		log.Printf("Failed to create Managed Identity credential: %v", err)
-		otherErrorCounter.Inc()
-		return fmt.Errorf("failed to create managed identity credential: %w", err)
-	}
-
-	// Create a service client for Cosmos DB
-	log.Println("Creating Cosmos DB service client...")
-	serviceClient, err := aztables.NewServiceClient(accountURL, cred, nil)
-	if err != nil {
-		log.Printf("Failed to create service client: %v", err)
-		otherErrorCounter.Inc()
-		return fmt.Errorf("failed to create service client: %w", err)
+		return nil, fmt.Errorf("failed to create managed identity credential: %w", err)
 	}
+	return cred, nil
+}
 
+func createTable(ctx context.Context, client tableClient, tableName string) error {
 	// Attempt to create the table
 	log.Printf("Attempting to create table: %s", tableName)
-	_, err = serviceClient.CreateTable(ctx, tableName, nil)
+	start := time.Now()
+	err := client.CreateTable(ctx)
+	elapsed := time.Since(start).Seconds()
 	
 	if err != nil {
 		// Use Azure SDK's ResponseError for better error handling
@@ -140,6 +227,7 @@ func performCosmosOperation(accountURL, tableName string) error {
 			// Check HTTP status code for authentication/authorization errors
 			if respErr.StatusCode == http.StatusUnauthorized || respErr.StatusCode == http.StatusForbidden {
 				log.Printf("Authentication/Authorization error (HTTP %d): %v", respErr.StatusCode, err)
+				operationDuration.WithLabelValues(client.kind(), "create_table", "auth_error").Observe(elapsed)
 				authErrorCounter.Inc()
 				return fmt.Errorf("authentication error: %w", err)
 			}
@@ -147,6 +235,7 @@ func performCosmosOperation(accountURL, tableName string) error {
 			// Check if table already exists (conflict or specific error code)
 			if respErr.StatusCode == http.StatusConflict || strings.Contains(respErr.ErrorCode, "TableAlreadyExists") {
 				log.Printf("Table already exists (expected): %s", tableName)
+				operationDuration.WithLabelValues(client.kind(), "create_table", "success").Observe(elapsed)
 				successCounter.Inc()
 				return nil
 			}
@@ -156,17 +245,20 @@ func performCosmosOperation(accountURL, tableName string) error {
 		errStr := err.Error()
 		if strings.Contains(strings.ToLower(errStr), "already exists") {
 			log.Printf("Table already exists (expected): %s", tableName)
+			operationDuration.WithLabelValues(client.kind(), "create_table", "success").Observe(elapsed)
 			successCounter.Inc()
 			return nil
 		}
 		
 		// Other errors
 		log.Printf("Error creating table: %v", err)
+		operationDuration.WithLabelValues(client.kind(), "create_table", "other_error").Observe(elapsed)
 		otherErrorCounter.Inc()
 		return fmt.Errorf("error creating table: %w", err)
 	}
 
 	log.Printf("Successfully created table: %s", tableName)
+	operationDuration.WithLabelValues(client.kind(), "create_table", "success").Observe(elapsed)
 	successCounter.Inc()
 	return nil
 }
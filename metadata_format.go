@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metadataFormatPartitionPrefix is prefixed to the node name so that each
+// pod reads and queries its own partition, rather than every pod in the
+// fleet hitting one hot partition whose size grows as pods write to it. The
+// node name, unlike the pod name, survives rollouts, so each new pod
+// overwrites its predecessor's entity instead of leaving it orphaned.
+const metadataFormatPartitionPrefix = "metadata-format-"
+
+// metadataProbeEntity is the typed form of the probe entity. Responses are
+// decoded into it inside the timed region so the latency includes the cost
+// of parsing each metadata format. Edm.Int64 is always serialized as a
+// string, and Edm.Binary as base64, which encoding/json decodes into []byte.
+type metadataProbeEntity struct {
+	PartitionKey string
+	RowKey       string
+	Node         string
+	Count        int64 `json:",string"`
+	Ratio        float64
+	Enabled      bool
+	UpdatedAt    time.Time
+	Payload      []byte
+}
+
+type metadataProbeQueryResponse struct {
+	Value []metadataProbeEntity `json:"value"`
+}
+
+var (
+	metadataFormatDuration = prometheus.NewHistogramVec(latencyHistogramOpts(
+		"cosmos_metadata_format_duration_seconds",
+		"Latency of entity reads and queries by OData metadata format, including decoding into typed values",
+	), []string{"client", "operation", "format"})
+	metadataFormatResponseBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cosmos_metadata_format_response_bytes",
+		Help:    "Response payload size of entity reads and queries by OData metadata format",
+		Buckets: prometheus.ExponentialBuckets(128, 2, 12),
+	}, []string{"client", "operation", "format"})
+
+	// metadataFormats maps the label value used in metrics to the Accept
+	// format sent to the service.
+	metadataFormats = []struct {
+		label  string
+		format aztables.MetadataFormat
+	}{
+		{"none", aztables.MetadataFormatNone},
+		{"minimal", aztables.MetadataFormatMinimal},
+		{"full", aztables.MetadataFormatFull},
+	}
+)
+
+func init() {
+	prometheus.MustRegister(metadataFormatDuration)
+	prometheus.MustRegister(metadataFormatResponseBytes)
+}
+
+// runMetadataFormatComparison upserts a probe entity and then reads and
+// queries it with each OData metadata format, recording latency and response
+// payload size per format. The number of rounds is set by
+// METADATA_FORMAT_ITERATIONS (default 10).
+func runMetadataFormatComparison(ctx context.Context, client tableClient) error {
+	iterations := 10
+	if v := os.Getenv("METADATA_FORMAT_ITERATIONS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid METADATA_FORMAT_ITERATIONS %q", v)
+		}
+		iterations = n
+	}
+
+	// Fall back to the hostname when running outside the DaemonSet
+	rowKey := os.Getenv("NODE_NAME")
+	if rowKey == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to get hostname: %w", err)
+		}
+		rowKey = hostname
+	}
+	partitionKey := metadataFormatPartitionPrefix + rowKey
+
+	// Typed properties make the difference between minimal and full
+	// metadata visible, since full metadata annotates every non-string type.
+	entity := aztables.EDMEntity{
+		Entity: aztables.Entity{
+			PartitionKey: partitionKey,
+			RowKey:       rowKey,
+		},
+		Properties: map[string]any{
+			"Node":      rowKey,
+			"Count":     aztables.EDMInt64(42),
+			"Ratio":     1.5,
+			"Enabled":   true,
+			"UpdatedAt": aztables.EDMDateTime(time.Now().UTC()),
+			"Payload":   aztables.EDMBinary([]byte("cosmos-msi-scale-test")),
+		},
+	}
+	body, err := json.Marshal(entity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal probe entity: %w", err)
+	}
+	if err := client.UpsertEntity(ctx, body); err != nil {
+		return fmt.Errorf("failed to upsert probe entity: %w", err)
+	}
+
+	log.Printf("Running metadata format comparison (%d iterations)", iterations)
+	// Restricting the query to this pod's entity keeps the result set, and so
+	// the payload size, identical across pods and over time.
+	filter := fmt.Sprintf("PartitionKey eq '%s' and RowKey eq '%s'",
+		strings.ReplaceAll(partitionKey, "'", "''"), strings.ReplaceAll(rowKey, "'", "''"))
+	for i := 0; i < iterations; i++ {
+		for _, mf := range metadataFormats {
+			start := time.Now()
+			payload, err := client.GetEntity(ctx, partitionKey, rowKey, mf.format)
+			if err != nil {
+				return fmt.Errorf("get entity with %s metadata: %w", mf.label, err)
+			}
+			var got metadataProbeEntity
+			if err := json.Unmarshal(payload, &got); err != nil {
+				return fmt.Errorf("decode entity with %s metadata: %w", mf.label, err)
+			}
+			recordMetadataFormatSample(client.kind(), "get_entity", mf.label, time.Since(start), payload)
+
+			start = time.Now()
+			payload, err = client.QueryEntities(ctx, filter, 1, mf.format)
+			if err != nil {
+				return fmt.Errorf("query entities with %s metadata: %w", mf.label, err)
+			}
+			var page metadataProbeQueryResponse
+			if err := json.Unmarshal(payload, &page); err != nil {
+				return fmt.Errorf("decode query with %s metadata: %w", mf.label, err)
+			}
+			recordMetadataFormatSample(client.kind(), "query_entities", mf.label, time.Since(start), payload)
+		}
+	}
+	log.Printf("Metadata format comparison complete")
+	return nil
+}
+
+func recordMetadataFormatSample(kind, operation, format string, elapsed time.Duration, payload []byte) {
+	metadataFormatDuration.WithLabelValues(kind, operation, format).Observe(elapsed.Seconds())
+	metadataFormatResponseBytes.WithLabelValues(kind, operation, format).Observe(float64(len(payload)))
+}
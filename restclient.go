@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+)
+
+const (
+	tableServiceVersion = "2019-02-02"
+	restRequestTimeout  = 30 * time.Second
+
+	// tokenRefreshMargin matches the SDK's BearerTokenPolicy, which fetches a
+	// new token once the cached one is within five minutes of expiring.
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+// restTableClient speaks the Table REST protocol directly over net/http,
+// with a bearer token from the configured credential. It deliberately has no
+// retry, logging or tracing policies so that its latency can be compared
+// with the aztables pipeline. Like the SDK's bearer token policy, it caches
+// the access token until shortly before it expires rather than calling the
+// credential on every request.
+type restTableClient struct {
+	accountURL string
+	table      string
+	scope      string
+	cred       azcore.TokenCredential
+	client     *http.Client
+
+	tokenMu sync.Mutex
+	token   azcore.AccessToken
+}
+
+func newRESTTableClient(accountURL, tableName string, cred azcore.TokenCredential) (*restTableClient, error) {
+	u, err := url.Parse(accountURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid account URL %q", accountURL)
+	}
+
+	// Match aztables: Cosmos endpoints use the Cosmos audience, everything
+	// else is treated as Table Storage.
+	scope := "https://storage.azure.com/.default"
+	if strings.Contains(u.Host, ".table.cosmos.") || strings.Contains(u.Host, ".table.cosmosdb.") {
+		scope = "https://cosmos.azure.com/.default"
+	}
+
+	return &restTableClient{
+		accountURL: strings.TrimSuffix(accountURL, "/"),
+		table:      tableName,
+		scope:      scope,
+		cred:       cred,
+		client:     &http.Client{Timeout: restRequestTimeout},
+	}, nil
+}
+
+func (c *restTableClient) kind() string { return "rest" }
+
+func (c *restTableClient) CreateTable(ctx context.Context) error {
+	body, err := json.Marshal(map[string]string{"TableName": c.table})
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, http.MethodPost, "/Tables", nil, body, aztables.MetadataFormatMinimal, http.StatusCreated, http.StatusNoContent)
+	return err
+}
+
+func (c *restTableClient) UpsertEntity(ctx context.Context, entity []byte) error {
+	var keys struct {
+		PartitionKey string
+		RowKey       string
+	}
+	if err := json.Unmarshal(entity, &keys); err != nil {
+		return fmt.Errorf("failed to read entity keys: %w", err)
+	}
+	// PUT without If-Match is Insert Or Replace Entity
+	_, err := c.do(ctx, http.MethodPut, c.entityPath(keys.PartitionKey, keys.RowKey), nil, entity, aztables.MetadataFormatMinimal, http.StatusNoContent)
+	return err
+}
+
+func (c *restTableClient) GetEntity(ctx context.Context, partitionKey, rowKey string, format aztables.MetadataFormat) ([]byte, error) {
+	return c.do(ctx, http.MethodGet, c.entityPath(partitionKey, rowKey), nil, nil, format, http.StatusOK)
+}
+
+func (c *restTableClient) QueryEntities(ctx context.Context, filter string, top int32, format aztables.MetadataFormat) ([]byte, error) {
+	query := url.Values{}
+	query.Set("$filter", filter)
+	query.Set("$top", strconv.Itoa(int(top)))
+	return c.do(ctx, http.MethodGet, "/"+url.PathEscape(c.table)+"()", query, nil, format, http.StatusOK)
+}
+
+// entityPath builds the point address of an entity. Single quotes in keys
+// are doubled as required by OData string literals.
+func (c *restTableClient) entityPath(partitionKey, rowKey string) string {
+	escape := func(key string) string {
+		return url.PathEscape(strings.ReplaceAll(key, "'", "''"))
+	}
+	return fmt.Sprintf("/%s(PartitionKey='%s',RowKey='%s')", url.PathEscape(c.table), escape(partitionKey), escape(rowKey))
+}
+
+// accessToken returns the cached token, fetching a new one from the
+// credential when there is none or it is about to expire.
+func (c *restTableClient) accessToken(ctx context.Context) (azcore.AccessToken, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	if c.token.Token != "" && time.Until(c.token.ExpiresOn) > tokenRefreshMargin {
+		return c.token, nil
+	}
+	token, err := c.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{c.scope}})
+	if err != nil {
+		return azcore.AccessToken{}, err
+	}
+	c.token = token
+	return token, nil
+}
+
+// do sends a single request and returns the response body. Any status not
+// in expected is returned as an *azcore.ResponseError, the same error type
+// the SDK produces.
+func (c *restTableClient) do(ctx context.Context, method, path string, query url.Values, body []byte, format aztables.MetadataFormat, expected ...int) ([]byte, error) {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reqURL := c.accountURL + path
+	if len(query) > 0 {
+		// The Table service expects spaces in $filter as %20 rather than +
+		reqURL += "?" + strings.ReplaceAll(query.Encode(), "+", "%20")
+	}
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	req.Header.Set("x-ms-version", tableServiceVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("DataServiceVersion", "3.0")
+	req.Header.Set("MaxDataServiceVersion", "3.0;NetFx")
+	req.Header.Set("Accept", string(format))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Prefer", "return-no-content")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return io.ReadAll(resp.Body)
+		}
+	}
+	return nil, runtime.NewResponseError(resp)
+}
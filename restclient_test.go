@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+)
+
+// staticCredential issues "test-token" valid for expiresIn (an hour when
+// unset) and counts how often it is asked for one.
+type staticCredential struct {
+	expiresIn time.Duration
+	calls     int
+}
+
+func (c *staticCredential) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.calls++
+	expiresIn := c.expiresIn
+	if expiresIn == 0 {
+		expiresIn = time.Hour
+	}
+	return azcore.AccessToken{Token: "test-token", ExpiresOn: time.Now().Add(expiresIn)}, nil
+}
+
+// recordedRequest captures the parts of a request the tests assert on.
+type recordedRequest struct {
+	requestURI string
+	method     string
+	header     http.Header
+	body       string
+}
+
+func newRESTTestServer(t *testing.T, status int, respBody string) (*restTableClient, *[]recordedRequest) {
+	t.Helper()
+	var requests []recordedRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, recordedRequest{
+			requestURI: r.RequestURI,
+			method:     r.Method,
+			header:     r.Header.Clone(),
+			body:       string(body),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(respBody))
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := newRESTTableClient(srv.URL, "ScaleTestTable", &staticCredential{})
+	if err != nil {
+		t.Fatalf("newRESTTableClient: %v", err)
+	}
+	return client, &requests
+}
+
+func TestRESTTableClientGetEntity(t *testing.T) {
+	client, requests := newRESTTestServer(t, http.StatusOK, `{"PartitionKey":"o'brien","RowKey":"a b"}`)
+
+	payload, err := client.GetEntity(context.Background(), "o'brien", "a b", aztables.MetadataFormatFull)
+	if err != nil {
+		t.Fatalf("GetEntity: %v", err)
+	}
+	if string(payload) != `{"PartitionKey":"o'brien","RowKey":"a b"}` {
+		t.Errorf("payload = %s", payload)
+	}
+
+	req := (*requests)[0]
+	// The doubled quote inside the key is percent-encoded on the wire, as
+	// the SDK does; the service decodes the path before parsing the key.
+	if want := "/ScaleTestTable(PartitionKey='o%27%27brien',RowKey='a%20b')"; req.method != http.MethodGet || req.requestURI != want {
+		t.Errorf("request = %s %s, want GET %s", req.method, req.requestURI, want)
+	}
+	for name, want := range map[string]string{
+		"Authorization": "Bearer test-token",
+		"x-ms-version":  tableServiceVersion,
+		"Accept":        string(aztables.MetadataFormatFull),
+	} {
+		if got := req.header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if req.header.Get("x-ms-date") == "" {
+		t.Error("x-ms-date header missing")
+	}
+}
+
+func TestRESTTableClientQueryEntitiesEncodesFilter(t *testing.T) {
+	client, requests := newRESTTestServer(t, http.StatusOK, `{"value":[]}`)
+
+	if _, err := client.QueryEntities(context.Background(), "PartitionKey eq 'p'", 5, aztables.MetadataFormatNone); err != nil {
+		t.Fatalf("QueryEntities: %v", err)
+	}
+
+	req := (*requests)[0]
+	if want := "/ScaleTestTable()?%24filter=PartitionKey%20eq%20%27p%27&%24top=5"; req.requestURI != want {
+		t.Errorf("request URI = %s, want %s", req.requestURI, want)
+	}
+	if got := req.header.Get("Accept"); got != string(aztables.MetadataFormatNone) {
+		t.Errorf("Accept = %q", got)
+	}
+}
+
+func TestRESTTableClientUnexpectedStatusIsResponseError(t *testing.T) {
+	client, _ := newRESTTestServer(t, http.StatusForbidden, `{"odata.error":{"code":"Forbidden","message":{"value":"denied"}}}`)
+
+	_, err := client.GetEntity(context.Background(), "p", "r", aztables.MetadataFormatMinimal)
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		t.Fatalf("error = %v, want *azcore.ResponseError", err)
+	}
+	if respErr.StatusCode != http.StatusForbidden {
+		t.Errorf("StatusCode = %d, want %d", respErr.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestRESTTableClientCachesToken(t *testing.T) {
+	for name, tc := range map[string]struct {
+		expiresIn time.Duration
+		wantCalls int
+	}{
+		"valid token is reused":          {time.Hour, 1},
+		"token near expiry is refreshed": {time.Minute, 3},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, requests := newRESTTestServer(t, http.StatusOK, `{}`)
+			cred := &staticCredential{expiresIn: tc.expiresIn}
+			client.cred = cred
+
+			for i := 0; i < 3; i++ {
+				if _, err := client.GetEntity(context.Background(), "p", "r", aztables.MetadataFormatNone); err != nil {
+					t.Fatalf("GetEntity: %v", err)
+				}
+			}
+			if cred.calls != tc.wantCalls {
+				t.Errorf("GetToken calls = %d, want %d", cred.calls, tc.wantCalls)
+			}
+			for _, req := range *requests {
+				if got := req.header.Get("Authorization"); got != "Bearer test-token" {
+					t.Errorf("Authorization = %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateTableWithRESTClientTreatsConflictAsSuccess(t *testing.T) {
+	client, requests := newRESTTestServer(t, http.StatusConflict,
+		`{"odata.error":{"code":"TableAlreadyExists","message":{"lang":"en-US","value":"The table specified already exists."}}}`)
+
+	if err := createTable(context.Background(), client, "ScaleTestTable"); err != nil {
+		t.Fatalf("createTable: %v", err)
+	}
+
+	req := (*requests)[0]
+	if req.method != http.MethodPost || req.requestURI != "/Tables" {
+		t.Errorf("request = %s %s, want POST /Tables", req.method, req.requestURI)
+	}
+	if req.body != `{"TableName":"ScaleTestTable"}` {
+		t.Errorf("body = %s", req.body)
+	}
+	if got := req.header.Get("Prefer"); got != "return-no-content" {
+		t.Errorf("Prefer = %q", got)
+	}
+}
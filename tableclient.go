@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+)
+
+// tableClient is the subset of Table operations the probe performs. It lets
+// the aztables SDK be swapped for the raw REST client so the two can be
+// compared under the same load. Failed service calls return an
+// *azcore.ResponseError with either implementation.
+type tableClient interface {
+	// kind identifies the implementation in metric labels.
+	kind() string
+	CreateTable(ctx context.Context) error
+	UpsertEntity(ctx context.Context, entity []byte) error
+	// GetEntity and QueryEntities return the raw response payload so that
+	// callers can measure its size.
+	GetEntity(ctx context.Context, partitionKey, rowKey string, format aztables.MetadataFormat) ([]byte, error)
+	QueryEntities(ctx context.Context, filter string, top int32, format aztables.MetadataFormat) ([]byte, error)
+}
+
+// newTableClient creates the client selected by TABLE_CLIENT: "sdk" (the
+// default) uses aztables and "rest" uses restTableClient.
+func newTableClient(accountURL, tableName string, cred azcore.TokenCredential) (tableClient, error) {
+	switch mode := os.Getenv("TABLE_CLIENT"); mode {
+	case "", "sdk":
+		log.Println("Creating Cosmos DB service client...")
+		serviceClient, err := aztables.NewServiceClient(accountURL, cred, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &sdkTableClient{service: serviceClient, table: serviceClient.NewClient(tableName), name: tableName}, nil
+	case "rest":
+		log.Println("Creating raw REST table client...")
+		return newRESTTableClient(accountURL, tableName, cred)
+	default:
+		return nil, fmt.Errorf("unknown TABLE_CLIENT %q", mode)
+	}
+}
+
+// sdkTableClient implements tableClient with the aztables SDK.
+type sdkTableClient struct {
+	service *aztables.ServiceClient
+	table   *aztables.Client
+	name    string
+}
+
+func (c *sdkTableClient) kind() string { return "sdk" }
+
+func (c *sdkTableClient) CreateTable(ctx context.Context) error {
+	_, err := c.service.CreateTable(ctx, c.name, nil)
+	return err
+}
+
+func (c *sdkTableClient) UpsertEntity(ctx context.Context, entity []byte) error {
+	_, err := c.table.UpsertEntity(ctx, entity, nil)
+	return err
+}
+
+func (c *sdkTableClient) GetEntity(ctx context.Context, partitionKey, rowKey string, format aztables.MetadataFormat) ([]byte, error) {
+	var resp *http.Response
+	_, err := c.table.GetEntity(runtime.WithCaptureResponse(ctx, &resp), partitionKey, rowKey, &aztables.GetEntityOptions{
+		Format: to.Ptr(format),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return runtime.Payload(resp)
+}
+
+func (c *sdkTableClient) QueryEntities(ctx context.Context, filter string, top int32, format aztables.MetadataFormat) ([]byte, error) {
+	pager := c.table.NewListEntitiesPager(&aztables.ListEntitiesOptions{
+		Filter: to.Ptr(filter),
+		Top:    to.Ptr(top),
+		Format: to.Ptr(format),
+	})
+	var resp *http.Response
+	if _, err := pager.NextPage(runtime.WithCaptureResponse(ctx, &resp)); err != nil {
+		return nil, err
+	}
+	return runtime.Payload(resp)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	serviceAccountDir           = "/var/run/secrets/kubernetes.io/serviceaccount"
+	defaultTokenAudience        = "api://AzureADTokenExchange"
+	defaultTokenExpirySeconds   = 3600
+	minimumTokenExpirySeconds   = 600
+	tokenRequestTimeout         = 30 * time.Second
+	credentialStepTokenRequest  = "k8s_token_request"
+	credentialStepEntraExchange = "entra_exchange"
+	credentialStepGetToken      = "get_token"
+)
+
+var credentialStepDuration = prometheus.NewHistogramVec(latencyHistogramOpts(
+	"cosmos_credential_step_duration_seconds",
+	"Latency of each credential acquisition step",
+), []string{"step", "result"})
+
+func init() {
+	prometheus.MustRegister(credentialStepDuration)
+}
+
+func observeCredentialStep(step string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	credentialStepDuration.WithLabelValues(step, result).Observe(time.Since(start).Seconds())
+}
+
+// tokenRequestSource fetches service account tokens on demand through the
+// Kubernetes TokenRequest API instead of reading the kubelet-projected
+// token file.
+type tokenRequestSource struct {
+	endpoint      string
+	tokenFile     string
+	audience      string
+	expirySeconds int64
+	client        *http.Client
+}
+
+// newTokenRequestSource configures a TokenRequest client from the pod's
+// in-cluster service account. TOKEN_REQUEST_API_SERVER overrides the API
+// server URL and TOKEN_REQUEST_BEARER_TOKEN_FILE the token used to call it
+// (for example to run against a local fake outside a pod),
+// SERVICE_ACCOUNT_NAME selects the service account, and
+// TOKEN_REQUEST_AUDIENCE and TOKEN_REQUEST_EXPIRATION_SECONDS control the
+// requested token.
+func newTokenRequestSource() (*tokenRequestSource, error) {
+	serviceAccount := os.Getenv("SERVICE_ACCOUNT_NAME")
+	if serviceAccount == "" {
+		return nil, fmt.Errorf("SERVICE_ACCOUNT_NAME environment variable is required for the tokenrequest credential mode")
+	}
+
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pod namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	apiServer := os.Getenv("TOKEN_REQUEST_API_SERVER")
+	tlsConfig := &tls.Config{}
+	if apiServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running in a cluster and TOKEN_REQUEST_API_SERVER is not set")
+		}
+		apiServer = "https://" + net.JoinHostPort(host, port)
+
+		caPEM, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cluster CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in cluster CA")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	tokenFile := os.Getenv("TOKEN_REQUEST_BEARER_TOKEN_FILE")
+	if tokenFile == "" {
+		tokenFile = serviceAccountDir + "/token"
+	}
+
+	audience := os.Getenv("TOKEN_REQUEST_AUDIENCE")
+	if audience == "" {
+		audience = defaultTokenAudience
+	}
+
+	expirySeconds := int64(defaultTokenExpirySeconds)
+	if v := os.Getenv("TOKEN_REQUEST_EXPIRATION_SECONDS"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < minimumTokenExpirySeconds {
+			return nil, fmt.Errorf("invalid TOKEN_REQUEST_EXPIRATION_SECONDS %q (minimum %d)", v, minimumTokenExpirySeconds)
+		}
+		expirySeconds = n
+	}
+
+	return &tokenRequestSource{
+		endpoint: fmt.Sprintf("%s/api/v1/namespaces/%s/serviceaccounts/%s/token",
+			strings.TrimSuffix(apiServer, "/"), url.PathEscape(namespace), url.PathEscape(serviceAccount)),
+		tokenFile:     tokenFile,
+		audience:      audience,
+		expirySeconds: expirySeconds,
+		client: &http.Client{
+			Timeout:   tokenRequestTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+type tokenRequest struct {
+	APIVersion string           `json:"apiVersion"`
+	Kind       string           `json:"kind"`
+	Spec       tokenRequestSpec `json:"spec"`
+}
+
+type tokenRequestSpec struct {
+	Audiences         []string `json:"audiences"`
+	ExpirationSeconds int64    `json:"expirationSeconds"`
+}
+
+type tokenRequestResponse struct {
+	Status struct {
+		Token               string    `json:"token"`
+		ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+	} `json:"status"`
+}
+
+// assertionTiming accumulates the time spent in the assertion callback
+// during one GetToken call, so that the Entra ID exchange can be timed on
+// its own.
+type assertionTiming struct {
+	calls   int
+	elapsed time.Duration
+	err     error
+}
+
+type assertionTimingKey struct{}
+
+// token requests a new service account token. It is used as the client
+// assertion callback, so it runs every time Entra ID needs a new assertion.
+func (s *tokenRequestSource) token(ctx context.Context) (token string, err error) {
+	start := time.Now()
+	defer func() {
+		observeCredentialStep(credentialStepTokenRequest, start, err)
+		if t, ok := ctx.Value(assertionTimingKey{}).(*assertionTiming); ok {
+			t.calls++
+			t.elapsed += time.Since(start)
+			t.err = err
+		}
+	}()
+
+	// The kubelet rotates the bound service account token, so read it on
+	// every call rather than caching it.
+	bearerToken, err := os.ReadFile(s.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read service account token: %w", err)
+	}
+
+	body, err := json.Marshal(tokenRequest{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenRequest",
+		Spec: tokenRequestSpec{
+			Audiences:         []string{s.audience},
+			ExpirationSeconds: s.expirySeconds,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(bearerToken)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Printf("TokenRequest failed: %v", err)
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token request response: %w", err)
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		log.Printf("TokenRequest returned HTTP %d: %s", resp.StatusCode, respBody)
+		return "", fmt.Errorf("token request returned HTTP %d", resp.StatusCode)
+	}
+
+	var tr tokenRequestResponse
+	if err := json.Unmarshal(respBody, &tr); err != nil {
+		return "", fmt.Errorf("failed to parse token request response: %w", err)
+	}
+	if tr.Status.Token == "" {
+		return "", fmt.Errorf("token request response has no token")
+	}
+	log.Printf("Obtained service account token via TokenRequest (expires %s)", tr.Status.ExpirationTimestamp.Format(time.RFC3339))
+	return tr.Status.Token, nil
+}
+
+// instrumentedCredential records the latency and outcome of every GetToken
+// call. When the call fetched a new assertion, the time spent outside the
+// assertion callback is also recorded as the Entra ID exchange step. Calls
+// served from the token cache or failing before the exchange record only
+// get_token.
+type instrumentedCredential struct {
+	azcore.TokenCredential
+}
+
+func (c instrumentedCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (tk azcore.AccessToken, err error) {
+	timing := &assertionTiming{}
+	start := time.Now()
+	defer func() {
+		observeCredentialStep(credentialStepGetToken, start, err)
+		if timing.calls > 0 && timing.err == nil {
+			exchange := time.Since(start) - timing.elapsed
+			result := "success"
+			if err != nil {
+				result = "error"
+			}
+			credentialStepDuration.WithLabelValues(credentialStepEntraExchange, result).Observe(exchange.Seconds())
+		}
+	}()
+	return c.TokenCredential.GetToken(context.WithValue(ctx, assertionTimingKey{}, timing), opts)
+}
+
+// newTokenRequestCredential builds a federated credential that uses a
+// TokenRequest-issued service account token as the client assertion.
+// TOKEN_REQUEST_CLIENT_ID is the managed identity that holds the federated
+// credential for the service account; it is separate from AZURE_CLIENT_ID,
+// which the msi mode uses for the kubelet identity. AZURE_TENANT_ID is the
+// tenant, and AZURE_AUTHORITY_HOST overrides the Entra ID endpoint.
+func newTokenRequestCredential() (azcore.TokenCredential, error) {
+	tenantID, clientID := os.Getenv("AZURE_TENANT_ID"), os.Getenv("TOKEN_REQUEST_CLIENT_ID")
+	if tenantID == "" || clientID == "" {
+		return nil, fmt.Errorf("AZURE_TENANT_ID and TOKEN_REQUEST_CLIENT_ID are required for the tokenrequest credential mode")
+	}
+
+	source, err := newTokenRequestSource()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &azidentity.ClientAssertionCredentialOptions{}
+	if authorityHost := os.Getenv("AZURE_AUTHORITY_HOST"); authorityHost != "" {
+		opts.Cloud = cloud.Configuration{ActiveDirectoryAuthorityHost: authorityHost}
+	}
+
+	cred, err := azidentity.NewClientAssertionCredential(tenantID, clientID, source.token, opts)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedCredential{cred}, nil
+}
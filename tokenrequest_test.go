@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newTokenRequestTestSource points a tokenRequestSource at a fake API server
+// through the same environment overrides used for local testing.
+func newTokenRequestTestSource(t *testing.T, handler http.HandlerFunc) *tokenRequestSource {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("sa-bearer\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SERVICE_ACCOUNT_NAME", "cosmos-msi-sa")
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("TOKEN_REQUEST_API_SERVER", srv.URL)
+	t.Setenv("TOKEN_REQUEST_BEARER_TOKEN_FILE", tokenFile)
+	t.Setenv("TOKEN_REQUEST_AUDIENCE", "api://test-audience")
+	t.Setenv("TOKEN_REQUEST_EXPIRATION_SECONDS", "900")
+
+	source, err := newTokenRequestSource()
+	if err != nil {
+		t.Fatalf("newTokenRequestSource: %v", err)
+	}
+	return source
+}
+
+func TestTokenRequestSourceToken(t *testing.T) {
+	source := newTokenRequestTestSource(t, func(w http.ResponseWriter, r *http.Request) {
+		if want := "/api/v1/namespaces/default/serviceaccounts/cosmos-msi-sa/token"; r.Method != http.MethodPost || r.URL.Path != want {
+			t.Errorf("request = %s %s, want POST %s", r.Method, r.URL.Path, want)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer sa-bearer" {
+			t.Errorf("Authorization = %q, want %q", auth, "Bearer sa-bearer")
+		}
+		var req tokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode body: %v", err)
+		}
+		if req.Kind != "TokenRequest" || len(req.Spec.Audiences) != 1 || req.Spec.Audiences[0] != "api://test-audience" || req.Spec.ExpirationSeconds != 900 {
+			t.Errorf("unexpected TokenRequest %+v", req)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status":{"token":"federated-token","expirationTimestamp":"2026-10-17T00:00:00Z"}}`))
+	})
+
+	token, err := source.token(context.Background())
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	if token != "federated-token" {
+		t.Errorf("token = %q, want %q", token, "federated-token")
+	}
+}
+
+func TestTokenRequestSourceTokenErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		status int
+		body   string
+	}{
+		"forbidden": {http.StatusForbidden, `{"kind":"Status","reason":"Forbidden"}`},
+		"no token":  {http.StatusCreated, `{"status":{}}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			source := newTokenRequestTestSource(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			})
+			if _, err := source.token(context.Background()); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+// assertingCredential stands in for ClientAssertionCredential: it calls the
+// assertion callback and then spends exchangeTime "talking to Entra ID".
+type assertingCredential struct {
+	getAssertion func(context.Context) (string, error)
+	exchangeTime time.Duration
+}
+
+func (c assertingCredential) GetToken(ctx context.Context, _ policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	if _, err := c.getAssertion(ctx); err != nil {
+		return azcore.AccessToken{}, err
+	}
+	time.Sleep(c.exchangeTime)
+	return azcore.AccessToken{Token: "entra-token"}, nil
+}
+
+func credentialStepCount(t *testing.T, step, result string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := credentialStepDuration.WithLabelValues(step, result).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestInstrumentedCredentialRecordsSteps(t *testing.T) {
+	source := newTokenRequestTestSource(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status":{"token":"federated-token"}}`))
+	})
+	cred := instrumentedCredential{assertingCredential{getAssertion: source.token, exchangeTime: 10 * time.Millisecond}}
+
+	tokenRequests := credentialStepCount(t, credentialStepTokenRequest, "success")
+	exchanges := credentialStepCount(t, credentialStepEntraExchange, "success")
+	getTokens := credentialStepCount(t, credentialStepGetToken, "success")
+
+	if _, err := cred.GetToken(context.Background(), policy.TokenRequestOptions{}); err != nil {
+		t.Fatalf("GetToken: %v", err)
+	}
+
+	for _, c := range []struct {
+		step   string
+		before uint64
+	}{
+		{credentialStepTokenRequest, tokenRequests},
+		{credentialStepEntraExchange, exchanges},
+		{credentialStepGetToken, getTokens},
+	} {
+		if got := credentialStepCount(t, c.step, "success"); got != c.before+1 {
+			t.Errorf("%s samples = %d, want %d", c.step, got, c.before+1)
+		}
+	}
+}
+
+func TestInstrumentedCredentialSkipsExchangeWhenAssertionFails(t *testing.T) {
+	source := newTokenRequestTestSource(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	cred := instrumentedCredential{assertingCredential{getAssertion: source.token}}
+
+	tokenRequests := credentialStepCount(t, credentialStepTokenRequest, "error")
+	exchangeSuccesses := credentialStepCount(t, credentialStepEntraExchange, "success")
+	exchangeErrors := credentialStepCount(t, credentialStepEntraExchange, "error")
+	getTokens := credentialStepCount(t, credentialStepGetToken, "error")
+
+	if _, err := cred.GetToken(context.Background(), policy.TokenRequestOptions{}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if got := credentialStepCount(t, credentialStepTokenRequest, "error"); got != tokenRequests+1 {
+		t.Errorf("k8s_token_request error samples = %d, want %d", got, tokenRequests+1)
+	}
+	if got := credentialStepCount(t, credentialStepGetToken, "error"); got != getTokens+1 {
+		t.Errorf("get_token error samples = %d, want %d", got, getTokens+1)
+	}
+	if credentialStepCount(t, credentialStepEntraExchange, "success") != exchangeSuccesses ||
+		credentialStepCount(t, credentialStepEntraExchange, "error") != exchangeErrors {
+		t.Error("entra_exchange was recorded although the assertion callback failed")
+	}
+}